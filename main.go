@@ -7,29 +7,117 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
     "reflect"
 
 	"github.com/influxdata/influxdb/client/v2"
-	"github.com/jpillora/backoff"
 	"github.com/jpillora/opts"
+
+	"github.com/jpillora/csv-to-influxdb/template"
 )
 
 var VERSION = "0.0.0-src"
 
+//groupKey builds a stable key identifying a (measurement, tag set) pair so
+//that columns routed to the same series by the template matcher land on the
+//same point.
+func groupKey(measurement string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := strings.Builder{}
+	b.WriteString(measurement)
+	for _, k := range keys {
+		b.WriteByte('\x00')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(tags[k])
+	}
+	return b.String()
+}
+
+//isPermissionError reports whether err looks like an Influx "not authorized"
+//or "insufficient privileges" response, which a non-admin user gets back
+//from SHOW DATABASES / CREATE DATABASE instead of a real connection failure.
+func isPermissionError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not authorized") || strings.Contains(msg, "insufficient privileges")
+}
+
+var (
+	intKind    = reflect.TypeOf(2)
+	floatKind  = reflect.TypeOf(2.2)
+	boolKind   = reflect.TypeOf(true)
+	stringKind = reflect.TypeOf("")
+)
+
+//promoteKind folds one more observed cell's kind into a column's existing
+//kind (nil if no cell has been observed yet for that column), returning the
+//kind the column should be treated as from now on. An int column seeing a
+//float is promoted to float; a bool column seeing anything else (or any
+//other kind mismatch) is demoted to string, since that's the only kind that
+//can hold every value already buffered for the column.
+func promoteKind(existing, observed reflect.Type) reflect.Type {
+	switch {
+	case existing == nil:
+		return observed
+	case existing == observed:
+		return existing
+	case existing == intKind && observed == floatKind:
+		return floatKind
+	case existing == floatKind && observed == intKind:
+		return floatKind
+	default:
+		return stringKind
+	}
+}
+
+//sealKind returns the kind a column should be locked to once the detection
+//window is over: whatever it already decided on, or stringKind if it never
+//saw a non-null value (e.g. an all-null column).
+func sealKind(existing reflect.Type) reflect.Type {
+	if existing == nil {
+		return stringKind
+	}
+	return existing
+}
+
 type config struct {
-	CSVFile         string `type:"arg" help:"<csv-file> must be a path a to valid CSV file with an initial header row"`
-	Server          string `help:"Server address"`
-	Database        string `help:"Database name"`
-	Measurement     string `help:"Measurement name"`
-	BatchSize       int    `help:"Batch insert size"`
-	TagColumns      string `help:"Separator(Comma)-separated list of columns to use as tags instead of fields. See Separator option"`
-	TimestampColumn string `short:"ts" help:"Header name of the column to use as the timestamp"`
-	TimestampFormat string `short:"tf" help:"Timestamp format used to parse all timestamp records"`
-	NoAutoCreate    bool   `help:"Disable automatic creation of database"`
-    Separator       string `short:"F" help:"input CSV separator character"`
+	CSVFile            string        `type:"arg" help:"<csv-file> must be a path a to valid CSV file with an initial header row"`
+	Server             string        `help:"Server address"`
+	Database           string        `help:"Database name"`
+	Measurement        string        `help:"Measurement name"`
+	BatchSize          int           `help:"Batch insert size"`
+	TagColumns         string        `help:"Separator(Comma)-separated list of columns to use as tags instead of fields. See Separator option"`
+	TimestampColumn    string        `short:"ts" help:"Header name of the column to use as the timestamp"`
+	TimestampFormat    string        `short:"tf" help:"Timestamp format used to parse all timestamp records"`
+	NoAutoCreate       bool          `help:"Disable automatic creation of database"`
+    Separator          string        `short:"F" help:"input CSV separator character"`
+	Username           string        `help:"Username used to authenticate against the server"`
+	Password           string        `help:"Password used to authenticate against the server"`
+	UserAgent          string        `help:"User agent sent with every request to the server"`
+	HttpTimeout        time.Duration `short:"to" help:"HTTP request timeout"`
+	InsecureSkipVerify bool          `help:"Disable TLS certificate verification"`
+	RetentionPolicy    string        `help:"Retention policy to write points into"`
+	Templates          []string      `short:"tpl" help:"Graphite-style template(s) used to derive measurement/tags/field from a dotted header name, e.g. \"cpu.* measurement.host.field\" (repeatable)"`
+	ForceFloat         bool          `help:"Force every integer field to float64, avoiding field-type collisions across shards"`
+	ForceString        bool          `help:"Skip numeric/boolean type inference; treat every field as a string"`
+	TreatNull          bool          `help:"Omit cells matching NullValues from fields instead of coercing them"`
+	NullValues         string        `help:"Separator-separated list of tokens treated as null, e.g. \"NA,NULL,-\""`
+	DetectRows         int           `help:"Number of rows to scan when inferring field types"`
+	Writers            int           `help:"Number of concurrent batch-write workers"`
+	MaxAttempts        int           `help:"Maximum write attempts per batch before giving up on it (0 = retry forever)"`
+	DeadLetter         string        `help:"File to write line-protocol points from batches that exhausted MaxAttempts to (an existing file is truncated)"`
+	Stdin              bool          `help:"Read the CSV from stdin instead of CSVFile (CSVFile may also be set to \"-\")"`
+	Output             string        `help:"Where points are written: \"influx\", \"lineproto\", or \"both\""`
+	OutputFile         string        `help:"Destination file for --output lineproto/both (empty or \"-\" means stdout)"`
 }
 
 func main() {
@@ -43,6 +131,12 @@ func main() {
 		TimestampColumn: "timestamp",
 		TimestampFormat: "2006-01-02 15:04:05",
         Separator:       ",",
+		UserAgent:       "csv-to-influxdb",
+		HttpTimeout:     30 * time.Second,
+		DetectRows:      100,
+		Writers:         4,
+		MaxAttempts:     10,
+		Output:          "influx",
 	}
 
 	//parse config
@@ -53,7 +147,30 @@ func main() {
 		Parse()
 
     var seprune = []rune(conf.Separator)[0] //string to rune conversion
-    
+
+	writeInflux, writeLineProto := false, false
+	switch conf.Output {
+	case "influx":
+		writeInflux = true
+	case "lineproto":
+		writeLineProto = true
+	case "both":
+		writeInflux, writeLineProto = true, true
+	default:
+		log.Fatalf("Invalid --output %q, must be \"influx\", \"lineproto\" or \"both\"", conf.Output)
+	}
+
+	//templates let a single CSV route each column to its own measurement/tags
+	//instead of the static Measurement/TagColumns pair
+	var matcher *template.Matcher
+	if len(conf.Templates) > 0 {
+		m, err := template.Parse(conf.Templates)
+		if err != nil {
+			log.Fatalf("Invalid template: %s", err)
+		}
+		matcher = m
+	}
+
 	//set tag names
 	tagNames := map[string]bool{}
 	for _, name := range strings.Split(conf.TagColumns, conf.Separator) {
@@ -63,6 +180,16 @@ func main() {
 		}
 	}
 
+	//set of tokens treated as a missing value, e.g. "NA,NULL,-"
+	nullValues := map[string]bool{}
+	for _, value := range strings.Split(conf.NullValues, conf.Separator) {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			nullValues[value] = true
+		}
+	}
+	isNull := func(r string) bool { return nullValues[r] }
+
 	//regular expressions
 	numbersRe := regexp.MustCompile(`\d`)
 	integerRe := regexp.MustCompile(`^\d+$`)
@@ -74,46 +201,117 @@ func main() {
 		log.Fatalf("time stamp regexp creation failed")
 	}
 
-	//influxdb client
-	c,err := client.NewHTTPClient(client.HTTPConfig{
-		Addr: conf.Server})
-	if err != nil {
-                log.Fatalf("Invalid server address: %s", err)
-        }
+	//sinks: one per destination requested via --output, fanned out to by
+	//every worker below
+	var sinks multiSink
+	var hs *httpSink
+	if writeInflux {
+		c, err := client.NewHTTPClient(client.HTTPConfig{
+			Addr:               conf.Server,
+			Username:           conf.Username,
+			Password:           conf.Password,
+			UserAgent:          conf.UserAgent,
+			Timeout:            conf.HttpTimeout,
+			InsecureSkipVerify: conf.InsecureSkipVerify})
+		if err != nil {
+			log.Fatalf("Invalid server address: %s", err)
+		}
 
-	dbsResp, err := c.Query(client.Query{Command: "SHOW DATABASES"})
-	if err != nil {
-		log.Fatalf("Invalid server address: %s", err)
-	}
-	dbExists := false
-	for _, v := range dbsResp.Results[0].Series[0].Values {
-		dbName := v[0].(string)
-		if conf.Database == dbName {
-			dbExists = true
-			break
+		dbsResp, err := c.Query(client.Query{Command: "SHOW DATABASES"})
+		if err == nil {
+			err = dbsResp.Error()
+		}
+		if err != nil {
+			if conf.NoAutoCreate && isPermissionError(err) {
+				log.Printf("Skipping database check: %s", err)
+			} else {
+				log.Fatalf("Invalid server address: %s", err)
+			}
+		} else {
+			dbExists := false
+			for _, v := range dbsResp.Results[0].Series[0].Values {
+				dbName := v[0].(string)
+				if conf.Database == dbName {
+					dbExists = true
+					break
+				}
+			}
+
+			if !dbExists {
+				if conf.NoAutoCreate {
+					log.Fatalf("Database '%s' does not exist", conf.Database)
+				}
+				createResp, err := c.Query(client.Query{Command: "CREATE DATABASE \"" + conf.Database + "\""})
+				if err == nil {
+					err = createResp.Error()
+				}
+				if err != nil {
+					if isPermissionError(err) {
+						log.Printf("Skipping database creation: %s", err)
+					} else {
+						log.Fatalf("Failed to create database: %s", err)
+					}
+				}
+			}
 		}
-	}
 
-	if !dbExists {
-		if conf.NoAutoCreate {
-			log.Fatalf("Database '%s' does not exist", conf.Database)
+		hs = &httpSink{c: c, maxAttempts: conf.MaxAttempts}
+		if conf.DeadLetter != "" {
+			hs.deadLetter, err = os.Create(conf.DeadLetter)
+			if err != nil {
+				log.Fatalf("Failed to create dead-letter file: %s", err)
+			}
 		}
-		_, err := c.Query(client.Query{Command: "CREATE DATABASE \"" + conf.Database + "\""})
+		sinks = append(sinks, hs)
+	}
+	if writeLineProto {
+		lp, err := newLineProtoSink(conf.OutputFile)
 		if err != nil {
-			log.Fatalf("Failed to create database: %s", err)
+			log.Fatalf("Failed to open %s: %s", conf.OutputFile, err)
 		}
+		sinks = append(sinks, lp)
 	}
+	defer sinks.Close()
 
-	//open csv file
-	f, err := os.Open(conf.CSVFile)
-	if err != nil {
-		log.Fatalf("Failed to open %s", conf.CSVFile)
+	//open the CSV source: a file, or stdin when requested - stdin can't be
+	//opened twice, which is exactly why this is a single streaming pass
+	var src io.Reader
+	if conf.Stdin || conf.CSVFile == "-" {
+		src = os.Stdin
+	} else {
+		f, err := os.Open(conf.CSVFile)
+		if err != nil {
+			log.Fatalf("Failed to open %s", conf.CSVFile)
+		}
+		defer f.Close()
+		src = f
 	}
 
 	//headers and init fn
 	var firstField string
 	var headers []string
+	//per-column (measurement, tags, field) derived from the header name, only
+	//populated when templates are in use
+	type headerRoute struct {
+		measurement string
+		tags        map[string]string
+		field       string
+		ok          bool
+	}
+	var headerRoutes []headerRoute
 	setHeaders := func(hdrs []string) {
+		if matcher != nil {
+			headerRoutes = make([]headerRoute, len(hdrs))
+			for i, value := range hdrs {
+				if value == conf.TimestampColumn {
+					continue
+				}
+				measurement, tags, field, ok := matcher.Match(value)
+				headerRoutes[i] = headerRoute{measurement, tags, field, ok}
+			}
+			headers = hdrs
+			return
+		}
 		//check timestamp and tag columns
 		hasTs := false
 		n := len(tagNames)
@@ -139,127 +337,215 @@ func main() {
 		headers = hdrs
 	}
 
-	var bpConfig = client.BatchPointsConfig{Database: conf.Database}
-	bp, _ := client.NewBatchPoints(bpConfig) //current batch
-	bpSize := 0
-	totalSize := 0
+	var bpConfig = client.BatchPointsConfig{Database: conf.Database, RetentionPolicy: conf.RetentionPolicy}
+	var totalSize int64
+
+	//writeBatch fans bp out to every configured sink, aborting the run on
+	//the first sink that gives up (the httpSink only does so once it either
+	//exhausts MaxAttempts with no dead letter configured, or the dead letter
+	//file itself can't be written to)
+	writeBatch := func(bp client.BatchPoints) {
+		if err := sinks.Write(bp); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+
+	//producer/consumer pipeline: the CSV parsing loop below is the sole
+	//producer, emitting points onto pointsCh; Writers workers each build
+	//their own BatchPoints of BatchSize and write them in parallel so that
+	//the network round-trip no longer serializes ingestion
+	pointsCh := make(chan *client.Point, conf.BatchSize)
+	var workers sync.WaitGroup
+	for w := 0; w < conf.Writers; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			bp, _ := client.NewBatchPoints(bpConfig)
+			size := 0
+			flush := func() {
+				if size == 0 {
+					return
+				}
+				writeBatch(bp)
+				bp, _ = client.NewBatchPoints(bpConfig)
+				size = 0
+			}
+			for pt := range pointsCh {
+				bp.AddPoint(pt)
+				size++
+				if size == conf.BatchSize {
+					flush()
+				}
+			}
+			flush()
+		}()
+	}
 
-	// lastCount := ""
+	fieldsKinds := map[string]reflect.Type{} //association nom de colonne / type
 
-	//write the current batch
- 	write := func() {
-		if bpSize == 0 {
+	//promote folds one more observed cell into fieldsKinds[value], upgrading
+	//the column's kind via promoteKind when a row doesn't fit what earlier
+	//rows decided; nulls and timestamp-shaped cells never change the kind.
+	promote := func(value, raw string) {
+		if isNull(raw) || timestampRe.MatchString(raw) {
 			return
 		}
-		b := backoff.Backoff{}
-		for {
-			if err := c.Write(bp); err != nil {
-				d := b.Duration()
-				log.Printf("Write failed: %s (retrying in %s)", err, d)
-				time.Sleep(d)
-				continue
+		var observed reflect.Type
+		switch {
+		case conf.ForceString:
+			observed = stringKind
+		case integerRe.MatchString(raw):
+			if conf.ForceFloat {
+				observed = floatKind
+			} else {
+				observed = intKind
 			}
-			break
+		case floatRe.MatchString(raw):
+			observed = floatKind
+		case trueRe.MatchString(raw), falseRe.MatchString(raw):
+			observed = boolKind
+		default:
+			observed = stringKind
 		}
-		//TODO(jpillora): wait until the new points become readable
-		// count := ""
-		// for count == lastCount {
-		// 	resp, err := c.Query(client.Query{Command: "SELECT count(" + firstField + ") FROM " + conf.Measurement, Database: conf.Database})
-		// 	if err != nil {
-		// 		log.Fatal("failed to count rows")
-		// 	}
-		// 	count = resp.Results[0].Series[0].Values[0][1].(string)
-		// }
-		//reset
-		bp, _ = client.NewBatchPoints(bpConfig)
-		bpSize = 0
-	} 
-    
-    //scan des premieres lignes pour determiner le type des mesures
-    fieldsKinds := map[string]interface{}{} //association nom de mesure / type
-	r := csv.NewReader(f)
-    
-    r.Comma = seprune // Use user-defined-delimitor instead of comma
-    
-    nokfields := 1
-	for i := 0; i < 100 ; i++ {
-        records, err := r.Read()
-		if nokfields == 0 {
-            break //on a trouve le type de toutes les mesures
-        }
-        nokfields = 0 //si on trouve tous les champs sur cette ligne ci, on reste à 0 et on sort de la boucle à la prochaine itération
-        if err != nil {
-			if err == io.EOF {
-				break
+		fieldsKinds[value] = promoteKind(fieldsKinds[value], observed)
+	}
+
+	//cast a raw cell into the value fieldsKinds decided it holds, same rules
+	//whether the cell ends up keyed by its header or by a templated field
+	castField := func(i int, value, r string) (interface{}, bool) {
+		if conf.TreatNull && isNull(r) {
+			return nil, false //omit the cell from fields entirely
+		}
+		if timestampRe.MatchString(r) {
+			t, err := time.Parse(conf.TimestampFormat, r)
+			if err != nil {
+				fmt.Printf("#%d: %s: Invalid time: %s\n", i, value, err)
+				return nil, false
 			}
-			log.Fatalf("CSV error: %s", err)
+			return t, true
+		} else if fieldsKinds[value] == intKind {
+			i, _ := strconv.Atoi(r)
+			return i, true
+		} else if fieldsKinds[value] == floatKind {
+			f, _ := strconv.ParseFloat(r, 64)
+			return f, true
+		} else if fieldsKinds[value] == boolKind {
+			return trueRe.MatchString(r), true
 		}
-		if i == 0 {
-			setHeaders(records)
-            nokfields = 1 //pour continer à chercher après la ligne des headers ...
-			continue
+		return r, true //probable crash DB car type de mesure inconnu
+	}
+
+	//processRow builds the point(s) for one CSV row (one, or several when a
+	//template fans a row out across measurements) and emits them
+	processRow := func(i int, records []string) {
+		var ts time.Time
+
+		if matcher != nil {
+			//one row can fan out into several points (one per measurement/tag
+			//set that its columns resolved to)
+			type group struct {
+				measurement string
+				tags        map[string]string
+				fields      map[string]interface{}
+			}
+			groups := map[string]*group{}
+			for key, value := range headers {
+				r := records[key]
+				if value == conf.TimestampColumn {
+					v, ok := castField(i, value, r)
+					if t, isTime := v.(time.Time); ok && isTime {
+						ts = t
+					}
+					continue
+				}
+				route := headerRoutes[key]
+				if !route.ok {
+					continue
+				}
+				v, ok := castField(i, value, r)
+				if !ok {
+					continue
+				}
+				gk := groupKey(route.measurement, route.tags)
+				g, found := groups[gk]
+				if !found {
+					g = &group{measurement: route.measurement, tags: route.tags, fields: map[string]interface{}{}}
+					groups[gk] = g
+				}
+				g.fields[route.field] = v
+			}
+			for _, g := range groups {
+				pt, err := client.NewPoint(g.measurement, g.tags, g.fields, ts)
+				if err != nil {
+					log.Fatalf("Failed to create point: %s", err)
+				}
+				pointsCh <- pt
+				atomic.AddInt64(&totalSize, 1)
+			}
+		} else {
+			tags := map[string]string{}
+			fields := map[string]interface{}{}
+
+			//move all into tags and fields
+			for key, value := range headers {
+				r := records[key]
+				//tags are just strings
+				if tagNames[value] {
+					tags[value] = r
+					continue
+				}
+				//fields require string parsing
+				v, ok := castField(i, value, r)
+				if !ok {
+					continue
+				}
+				if t, isTime := v.(time.Time); isTime && conf.TimestampColumn == value {
+					ts = t //the timestamp column!
+					continue
+				}
+				fields[value] = v
+			}
+
+			pt, err := client.NewPoint(conf.Measurement, tags, fields, ts)
+			if err != nil {
+				log.Fatalf("Failed to create point: %s", err)
+			}
+			pointsCh <- pt
+			atomic.AddInt64(&totalSize, 1)
 		}
-        
+	}
+
+	//sealDefaults locks in a string kind for any column that never had a
+	//non-null value during the detection window (e.g. an all-null column),
+	//instead of aborting the run
+	sealDefaults := func() {
 		for key, value := range headers {
-			r := records[key]
-			//tags are just strings
-			if tagNames[value] {
+			if tagNames[value] || value == conf.TimestampColumn {
 				continue
 			}
-			//fields require string parsing && on ne veut pas que leur type change au fur et à mesure qu'on rencontre des NULL ou des champs vides, donc on les cherche une bonne fois pour toutes, sur les 100 premieres lignes.
-            _,ok := fieldsKinds[value]            
-			if !ok {
-                nokfields++
-                if timestampRe.MatchString(r) {
-                    nokfields--
-                    continue
-                } else if integerRe.MatchString(r) {
-                    i, _ := strconv.Atoi(r)
-                    fieldsKinds[value] = reflect.TypeOf(i);
-                    nokfields--
-                } else if floatRe.MatchString(r) {
-                    f, _ := strconv.ParseFloat(r, 64)
-                    fieldsKinds[value] = reflect.TypeOf(f);
-                    nokfields--
-                } else if trueRe.MatchString(r) {
-                    fieldsKinds[value] = reflect.TypeOf(true);
-                    nokfields--
-                } else if falseRe.MatchString(r) {
-                    fieldsKinds[value] = reflect.TypeOf(false);
-                    nokfields--
-                } //si null, on verra sur les lignes suivantes. Et une mesure n'est pas sensée être un string. 
-            } 
-		}        
-        
-    }
-    f.Close()
-    
-	//open csv file again
-	f, err = os.Open(conf.CSVFile)
-	if err != nil {
-		log.Fatalf("Failed to open %s", conf.CSVFile)
-	}    
-    
-    //////TEST : affichier les types
-    for _,value := range headers {
-            _,isafield := fieldsKinds[value]
-            if tagNames[value] {
-				fmt.Printf("tag %s : string\n", value)
-			} else if value == conf.TimestampColumn {
-                fmt.Printf("timestamp %s\n", value)
-            } else if isafield {
-                fmt.Printf("mesure %s : %s\n", value, fieldsKinds[value])
-            } else {
-                fmt.Printf("pas de type trouvé sur les 100 premières lignes pour la colonne : %s\n",value)
-                fmt.Printf("sortie ...")
-                os.Exit(1)
-            }
-    }
-  
-     
-	//read csv, line by line
-	r = csv.NewReader(f)
-    r.Comma = seprune // Use user-defined-delimitor instead of comma
+			if matcher != nil && !headerRoutes[key].ok {
+				continue
+			}
+			if _, ok := fieldsKinds[value]; !ok {
+				fieldsKinds[value] = sealKind(fieldsKinds[value])
+				log.Printf("No type found in the first %d rows for column %s, defaulting to string", conf.DetectRows, value)
+			}
+		}
+	}
+
+	//single streaming pass: buffer up to DetectRows rows, folding every cell
+	//into fieldsKinds via promote (so a column can still be promoted from int
+	//to float on, say, its second row), then replay the buffer through
+	//processRow with the now-settled types before continuing row-by-row -
+	//this also makes --stdin possible, since stdin can't be read twice.
+	//The window can't be cut short just because every column already has a
+	//kind: a later buffered row may yet promote it, so we always scan the
+	//full window (or run out of input) before sealing.
+	r := csv.NewReader(src)
+	r.Comma = seprune // Use user-defined-delimitor instead of comma
+
+	sealed := false
+	var pending [][]string
 	for i := 0; ; i++ {
 		records, err := r.Read()
 		if err != nil {
@@ -273,62 +559,45 @@ func main() {
 			continue
 		}
 
-		// Create a point and add to batch
-		tags := map[string]string{}
-		fields := map[string]interface{}{}
-
-		var ts time.Time
+		if sealed {
+			processRow(i, records)
+			continue
+		}
 
-		//move all into tags and fields
 		for key, value := range headers {
-			r := records[key]
-			//tags are just strings
-			if tagNames[value] {
-				tags[value] = r
+			raw := records[key]
+			if tagNames[value] || value == conf.TimestampColumn {
 				continue
 			}
-			//fields require string parsing
-			if timestampRe.MatchString(r) {
-				t, err := time.Parse(conf.TimestampFormat, r)
-				if err != nil {
-					fmt.Printf("#%d: %s: Invalid time: %s\n", i, value, err)
-					continue
-				}
-				if conf.TimestampColumn == value {
-					ts = t //the timestamp column!
-					continue
-				}
-				fields[value] = t
-//			} else if integerRe.MatchString(r) {
-			} else if fieldsKinds[value] == reflect.TypeOf(2) {
-				i, _ := strconv.Atoi(r)
-				fields[value] = i
-//			} else if floatRe.MatchString(r) {
-			} else if fieldsKinds[value] == reflect.TypeOf(2.2) {
-				f, _ := strconv.ParseFloat(r, 64)
-				fields[value] = f
-//			} else if trueRe.MatchString(r) {
-			} else if fieldsKinds[value] == reflect.TypeOf(true) {
-				fields[value] = true
-//			} else if falseRe.MatchString(r) {
-			} else if fieldsKinds[value] == reflect.TypeOf(false) {
-				fields[value] = false
-			} else {
-				fields[value] = r //probable crash DB car type de mesure inconnu
+			if matcher != nil && !headerRoutes[key].ok {
+				continue
 			}
+			promote(value, raw)
 		}
+		pending = append(pending, records)
 
-		pt, err := client.NewPoint(conf.Measurement, tags, fields, ts)
-		bp.AddPoint(pt)
-
-		bpSize++
-		totalSize++
-		if bpSize == conf.BatchSize {
-			write()
+		if len(pending) >= conf.DetectRows {
+			sealDefaults()
+			for idx, buffered := range pending {
+				processRow(idx+1, buffered)
+			}
+			pending = nil
+			sealed = true
+		}
+	}
+	if !sealed {
+		sealDefaults()
+		for idx, buffered := range pending {
+			processRow(idx+1, buffered)
 		}
 	}
-	//send remainder
-	write()
-	log.Printf("Done (wrote %d points)", totalSize) 
-}
 
+	//no more points to produce; let the workers drain pointsCh and flush
+	close(pointsCh)
+	workers.Wait()
+	var deadLettered int64
+	if hs != nil {
+		deadLettered = atomic.LoadInt64(&hs.deadLettered)
+	}
+	log.Printf("Done (wrote %d points, %d dead-lettered)", totalSize-deadLettered, deadLettered)
+}
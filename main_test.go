@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPromoteKindIntToFloat(t *testing.T) {
+	got := promoteKind(intKind, floatKind)
+	if got != floatKind {
+		t.Errorf("int column observing a float cell should promote to float, got %v", got)
+	}
+	//order shouldn't matter once a column has seen a float
+	got = promoteKind(floatKind, intKind)
+	if got != floatKind {
+		t.Errorf("float column observing an int cell should stay float, got %v", got)
+	}
+}
+
+func TestPromoteKindBoolToString(t *testing.T) {
+	got := promoteKind(boolKind, stringKind)
+	if got != stringKind {
+		t.Errorf("bool column observing a non-bool cell should demote to string, got %v", got)
+	}
+	got = promoteKind(boolKind, intKind)
+	if got != stringKind {
+		t.Errorf("bool column observing an int cell should demote to string, got %v", got)
+	}
+}
+
+func TestSealKindAllNullColumn(t *testing.T) {
+	//a column whose cells are all null is never passed to promoteKind, so its
+	//kind stays nil until sealKind defaults it to string
+	got := sealKind(nil)
+	if got != stringKind {
+		t.Errorf("column that never saw a non-null value should seal to string, got %v", got)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/jpillora/backoff"
+)
+
+//sink is where a batch of points ends up once the ingestion pipeline has
+//built it. httpSink writes to a running InfluxDB; lineProtoSink serializes
+//to a file or stdout; a multiSink fans a batch out to several of these so
+//--output can be "influx", "lineproto" or "both".
+type sink interface {
+	Write(bp client.BatchPoints) error
+	Close() error
+}
+
+//httpSink writes batches to InfluxDB over HTTP, retrying with backoff until
+//it succeeds or maxAttempts is reached (0 means retry forever); on giving up
+//it either dead-letters the batch or returns the error to the caller.
+type httpSink struct {
+	c            client.Client
+	maxAttempts  int
+	deadLetter   *os.File
+	deadLetterMu sync.Mutex
+	deadLettered int64
+}
+
+func (s *httpSink) Write(bp client.BatchPoints) error {
+	b := &backoff.Backoff{}
+	for {
+		err := s.c.Write(bp)
+		if err == nil {
+			return nil
+		}
+		d := b.Duration()
+		if s.maxAttempts > 0 && int(b.Attempt()) >= s.maxAttempts {
+			if s.deadLetter == nil {
+				return fmt.Errorf("write failed after %d attempts: %s", s.maxAttempts, err)
+			}
+			log.Printf("Write failed after %d attempts: %s (sending batch to dead letter)", s.maxAttempts, err)
+			s.deadLetterMu.Lock()
+			for _, pt := range bp.Points() {
+				if _, werr := fmt.Fprintln(s.deadLetter, pt.String()); werr != nil {
+					s.deadLetterMu.Unlock()
+					return fmt.Errorf("write failed after %d attempts: %s (dead letter write failed: %s)", s.maxAttempts, err, werr)
+				}
+			}
+			s.deadLetterMu.Unlock()
+			atomic.AddInt64(&s.deadLettered, int64(len(bp.Points())))
+			return nil
+		}
+		log.Printf("Write failed: %s (retrying in %s)", err, d)
+		time.Sleep(d)
+	}
+}
+
+func (s *httpSink) Close() error {
+	if s.deadLetter != nil {
+		return s.deadLetter.Close()
+	}
+	return nil
+}
+
+//lineProtoSink serializes every point in a batch as InfluxDB Line Protocol,
+//one per line, so the output is consumable by `influx -import`, Telegraf's
+//file input, or Kapacitor replay without a running InfluxDB.
+type lineProtoSink struct {
+	w      io.Writer
+	closer io.Closer //nil when writing to stdout
+}
+
+//newLineProtoSink opens path for writing, or wraps stdout when path is ""
+//or "-".
+func newLineProtoSink(path string) (*lineProtoSink, error) {
+	if path == "" || path == "-" {
+		return &lineProtoSink{w: os.Stdout}, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &lineProtoSink{w: f, closer: f}, nil
+}
+
+func (s *lineProtoSink) Write(bp client.BatchPoints) error {
+	for _, pt := range bp.Points() {
+		if _, err := fmt.Fprintln(s.w, pt.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *lineProtoSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+//multiSink fans a batch out to every underlying sink, in order, stopping at
+//the first error.
+type multiSink []sink
+
+func (m multiSink) Write(bp client.BatchPoints) error {
+	for _, s := range m {
+		if err := s.Write(bp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiSink) Close() error {
+	var first error
+	for _, s := range m {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
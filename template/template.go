@@ -0,0 +1,117 @@
+// Package template parses Graphite-style templates and matches them against
+// dotted CSV header names to derive an InfluxDB measurement, a set of tags
+// and a field name, the same way Telegraf's graphite input maps metric
+// paths onto points.
+package template
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Template is a single parsed "filter template" pair, e.g. the line
+// "cpu.* measurement.host.field" parses into Filter "cpu.*" and
+// Parts []string{"measurement", "host", "field"}.
+type Template struct {
+	Filter string
+	Parts  []string
+}
+
+// Matcher holds a list of parsed templates and matches headers against them
+// in order, first match wins.
+type Matcher struct {
+	templates []Template
+}
+
+// Parse parses a list of Graphite-style template strings into a Matcher.
+// Each template is of the form "[filter ]part1.part2.part3...", where filter
+// is an optional glob matched against the whole header and defaults to "*".
+// Each part is either a role keyword (measurement, field, or field*) or any
+// other name, which is taken to be a tag key. field* is a greedy field,
+// consuming the rest of the header's segments into a single underscore
+// joined field name; it is only valid as the last part.
+func Parse(templates []string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, t := range templates {
+		tpl, err := parseOne(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %q: %s", t, err)
+		}
+		m.templates = append(m.templates, tpl)
+	}
+	return m, nil
+}
+
+func parseOne(t string) (Template, error) {
+	fields := strings.Fields(t)
+	filter := "*"
+	pattern := ""
+	switch len(fields) {
+	case 1:
+		pattern = fields[0]
+	case 2:
+		filter, pattern = fields[0], fields[1]
+	default:
+		return Template{}, fmt.Errorf("expected \"[filter ]template\", got %d fields", len(fields))
+	}
+	parts := strings.Split(pattern, ".")
+	seenTags := map[string]bool{}
+	for i, p := range parts {
+		if p == "" {
+			return Template{}, fmt.Errorf("empty part in template %q", pattern)
+		}
+		if p == "field*" && i != len(parts)-1 {
+			return Template{}, fmt.Errorf("field* must be the last part")
+		}
+		if p == "measurement" || p == "field" || p == "field*" {
+			continue
+		}
+		//two parts sharing the same tag name would overwrite each other's
+		//value when matched, silently dropping one of them
+		if seenTags[p] {
+			return Template{}, fmt.Errorf("tag name %q used more than once in template %q", p, pattern)
+		}
+		seenTags[p] = true
+	}
+	return Template{Filter: filter, Parts: parts}, nil
+}
+
+// Match maps header against the first template whose filter matches it,
+// that has no more parts than the header has segments, and that yields both
+// a measurement and a field; templates failing any of these are skipped. It
+// returns the derived measurement, tags and field name, and ok=false if no
+// template matched.
+func (m *Matcher) Match(header string) (measurement string, tags map[string]string, field string, ok bool) {
+	for _, tpl := range m.templates {
+		matched, err := filepath.Match(tpl.Filter, header)
+		if err != nil || !matched {
+			continue
+		}
+		segments := strings.Split(header, ".")
+		if len(segments) < len(tpl.Parts) {
+			continue
+		}
+		measurement = ""
+		tags = map[string]string{}
+		var fieldParts []string
+		for i, part := range tpl.Parts {
+			isLast := i == len(tpl.Parts)-1
+			switch {
+			case part == "measurement":
+				measurement = segments[i]
+			case part == "field":
+				fieldParts = append(fieldParts, segments[i])
+			case part == "field*" && isLast:
+				fieldParts = append(fieldParts, segments[i:]...)
+			default:
+				tags[part] = segments[i]
+			}
+		}
+		if measurement == "" || len(fieldParts) == 0 {
+			continue
+		}
+		return measurement, tags, strings.Join(fieldParts, "_"), true
+	}
+	return "", nil, "", false
+}